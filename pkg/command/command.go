@@ -0,0 +1,527 @@
+// Package command provides means to execute external commands and shell scripts.
+package command
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/SAP/jenkins-library/pkg/log"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ExecCommand is exposed so that the actual creation of the *exec.Cmd can be replaced by a mock in unit tests.
+var ExecCommand = exec.Command
+
+// GracefulShutdownTimeout is the grace period given to a command after it has been sent SIGTERM
+// before RunExecutableContext/RunShellContext escalates to SIGKILL.
+var GracefulShutdownTimeout = 10 * time.Second
+
+// maxErrorCategoryLineLength limits how much of a single line of console output is buffered while
+// scanning for error patterns. Lines exceeding this length are written through to stdout/stderr
+// unmodified but are not available for error-category matching.
+const maxErrorCategoryLineLength = 16 * 1024
+
+// Command defines the behavior around running executables and shell scripts on the file system.
+type Command struct {
+	// ErrorCategoryMapping allows categorizing errors based on patterns found in the command's
+	// console output. The map key is the error category (e.g. "build", "config"), the value is
+	// the list of patterns (each '*' being a wildcard, see matchPattern) mapped to it.
+	ErrorCategoryMapping map[string][]string
+
+	// Dir is the working directory the command is executed in. Leave empty to use the current
+	// process's working directory. Prefer SetDir over setting this directly.
+	Dir string
+
+	stdin         io.Reader
+	stdout        io.Writer
+	stderr        io.Writer
+	env           []string
+	appendEnv     bool
+	errorPatterns []ErrorPattern
+	exitCode      int
+}
+
+// ErrorPattern describes a single rule for classifying a line of command console output. Unlike
+// ErrorCategoryMapping's glob-with-'*' patterns, ErrorPattern supports full regular expressions,
+// a priority to resolve lines matching several patterns, and an optional capture group to extract
+// the message that actually gets logged instead of the whole line.
+type ErrorPattern struct {
+	Regexp       *regexp.Regexp
+	Category     log.ErrorCategory
+	Priority     int
+	CaptureGroup int
+}
+
+// errorPatternYAML is the on-disk YAML representation of an ErrorPattern, as loaded by
+// LoadErrorPatterns. Category is a name such as "build" or "config", resolved the same way
+// ErrorCategoryMapping's keys are (see errorCategoryFromString).
+type errorPatternYAML struct {
+	Pattern      string `yaml:"pattern"`
+	Category     string `yaml:"category"`
+	Priority     int    `yaml:"priority"`
+	CaptureGroup int    `yaml:"captureGroup"`
+}
+
+// LoadErrorPatterns reads a YAML file describing a list of error patterns, e.g.:
+//
+//	- pattern: '^\[ERROR\]'
+//	  category: build
+//	  priority: 10
+//	- pattern: 'npm ERR! (.*)'
+//	  category: build
+//	  priority: 5
+//	  captureGroup: 1
+//
+// so that teams can curate error-pattern libraries (Maven "[ERROR]" lines, npm "npm ERR!", go vet
+// output, ...) without recompiling steps.
+func LoadErrorPatterns(path string) ([]ErrorPattern, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read error pattern file '%v'", path)
+	}
+
+	var defs []errorPatternYAML
+	if err := yaml.Unmarshal(raw, &defs); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse error pattern file '%v'", path)
+	}
+
+	patterns := make([]ErrorPattern, 0, len(defs))
+	for _, def := range defs {
+		re, err := regexp.Compile(def.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid error pattern '%v'", def.Pattern)
+		}
+		patterns = append(patterns, ErrorPattern{
+			Regexp:       re,
+			Category:     errorCategoryFromString(def.Category),
+			Priority:     def.Priority,
+			CaptureGroup: def.CaptureGroup,
+		})
+	}
+	return patterns, nil
+}
+
+// SetErrorPatterns configures regex-based error categorization. When set, it takes priority over
+// ErrorCategoryMapping, which is kept around for callers that have not migrated yet.
+func (c *Command) SetErrorPatterns(patterns []ErrorPattern) {
+	c.errorPatterns = patterns
+}
+
+// ErrExecutionCancelled is returned by RunExecutableContext/RunShellContext when the supplied
+// context was cancelled, or its deadline exceeded, before the command terminated on its own.
+type ErrExecutionCancelled struct {
+	Cause error
+}
+
+func (e *ErrExecutionCancelled) Error() string {
+	return fmt.Sprintf("command execution cancelled: %v", e.Cause)
+}
+
+// Unwrap allows callers to use errors.Is/errors.As against context.Canceled/context.DeadlineExceeded.
+func (e *ErrExecutionCancelled) Unwrap() error {
+	return e.Cause
+}
+
+// GetExitCode returns the exit code of the last command that was run, or -1 if that command was
+// terminated by a signal. It is not updated when a command fails to start, so a Command that has
+// not run anything yet reports 0.
+func (c *Command) GetExitCode() int {
+	return c.exitCode
+}
+
+// Stdout redirects the stdout of the command execution.
+func (c *Command) Stdout(stdout io.Writer) {
+	c.stdout = stdout
+}
+
+// Stderr redirects the stderr of the command execution.
+func (c *Command) Stderr(stderr io.Writer) {
+	c.stderr = stderr
+}
+
+// SetEnv sets the environment variables used for the command execution, replacing any
+// environment the child process would otherwise inherit. Use AppendEnv to merge onto the current
+// environment instead.
+func (c *Command) SetEnv(env []string) {
+	c.env = env
+	c.appendEnv = false
+}
+
+// AppendEnv merges env onto the process's current environment instead of replacing it outright,
+// which saves callers from having to re-inject PATH, HOME, proxy variables, etc. themselves.
+// Duplicate keys are resolved with the same last-write-wins semantics as the Go standard library:
+// keys are compared case-insensitively on Windows, and oddly-formed entries beginning with '='
+// (Windows drive-letter variables such as "=C:=C:\...") are preserved rather than dropped.
+func (c *Command) AppendEnv(env []string) {
+	c.env = env
+	c.appendEnv = true
+}
+
+// SetStdin sets the reader RunExecutable feeds to the child process's stdin, e.g. to pipe a
+// payload into an external tool without writing it to a temporary file first.
+func (c *Command) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+// SetDir sets the working directory in which the command is executed.
+func (c *Command) SetDir(dir string) {
+	c.Dir = dir
+}
+
+func (c *Command) prepareOut() {
+	if c.stdout == nil {
+		c.stdout = os.Stdout
+	}
+	if c.stderr == nil {
+		c.stderr = os.Stderr
+	}
+}
+
+func (c *Command) setDirAndEnv(cmd *exec.Cmd) error {
+	if c.Dir != "" {
+		info, err := os.Stat(c.Dir)
+		if err != nil {
+			return errors.Wrapf(err, "working directory '%v' not found", c.Dir)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("working directory '%v' is not a directory", c.Dir)
+		}
+		cmd.Dir = c.Dir
+	}
+	switch {
+	case c.appendEnv:
+		base := cmd.Env
+		if base == nil {
+			base = os.Environ()
+		}
+		cmd.Env = mergeEnv(base, c.env)
+	case len(c.env) > 0:
+		cmd.Env = append(cmd.Env, c.env...)
+	}
+	return nil
+}
+
+// mergeEnv merges overrides onto base, keeping base's entries unless overrides assigns the same
+// key again. Order is preserved; a key that appears more than once keeps its first position but
+// takes the value of its last occurrence (matching os/exec's own de-duplication behavior).
+func mergeEnv(base, overrides []string) []string {
+	return mergeEnvForOS(base, overrides, runtime.GOOS)
+}
+
+func mergeEnvForOS(base, overrides []string, goos string) []string {
+	index := make(map[string]int, len(base)+len(overrides))
+	merged := make([]string, 0, len(base)+len(overrides))
+
+	apply := func(entries []string) {
+		for _, entry := range entries {
+			key := envKeyForOS(entry, goos)
+			if i, ok := index[key]; ok {
+				merged[i] = entry
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, entry)
+		}
+	}
+
+	apply(base)
+	apply(overrides)
+	return merged
+}
+
+// envKeyForOS extracts the "KEY" part of a "KEY=VALUE" environment entry. Entries with no '=' or
+// with a leading '=' (e.g. Windows drive-letter variables like "=C:=C:\...") have no usable key
+// and are keyed by their full content instead, so they are preserved rather than collapsed.
+func envKeyForOS(entry, goos string) string {
+	idx := strings.Index(entry, "=")
+	if idx <= 0 {
+		return entry
+	}
+	key := entry[:idx]
+	if goos == "windows" {
+		return strings.ToUpper(key)
+	}
+	return key
+}
+
+// RunShell runs the given script via the provided shell, e.g. RunShell("/bin/bash", "echo hello").
+// The script is passed to the shell via stdin so that no temporary file needs to be created on disk.
+func (c *Command) RunShell(shell, script string) error {
+	return c.RunShellContext(context.Background(), shell, script)
+}
+
+// RunShellContext behaves like RunShell but aborts the shell invocation once ctx is done, sending
+// SIGTERM to the shell process and escalating to SIGKILL after GracefulShutdownTimeout.
+func (c *Command) RunShellContext(ctx context.Context, shell, script string) error {
+	c.prepareOut()
+
+	cmd := ExecCommand(shell)
+	if err := c.setDirAndEnv(cmd); err != nil {
+		return err
+	}
+
+	return c.execute(ctx, cmd, func(stdin io.WriteCloser) {
+		defer stdin.Close()
+		io.WriteString(stdin, script)
+	})
+}
+
+// RunExecutable runs the given executable with the provided parameters.
+// Parameters containing `$VAR`/`${VAR}` references are interpolated against the environment
+// variables previously set via SetEnv.
+func (c *Command) RunExecutable(executable string, params ...string) error {
+	return c.RunExecutableContext(context.Background(), executable, params...)
+}
+
+// RunExecutableContext behaves like RunExecutable but aborts the execution once ctx is done,
+// sending SIGTERM to the child process and escalating to SIGKILL after GracefulShutdownTimeout.
+// If ctx is cancelled or its deadline is exceeded before the command finishes on its own, the
+// returned error is an *ErrExecutionCancelled wrapping context.Canceled/context.DeadlineExceeded.
+func (c *Command) RunExecutableContext(ctx context.Context, executable string, params ...string) error {
+	c.prepareOut()
+
+	params = interpolateEnvVars(params, c.env)
+
+	cmd := ExecCommand(executable, params...)
+	if err := c.setDirAndEnv(cmd); err != nil {
+		return err
+	}
+
+	return c.execute(ctx, cmd, nil)
+}
+
+// execute starts cmd, forwards its stdout/stderr and waits for it to finish, monitoring ctx in
+// parallel. feedStdin, if non-nil, is run in its own goroutine and given a pipe to the child's
+// stdin; it is responsible for closing that pipe once it is done writing.
+func (c *Command) execute(ctx context.Context, cmd *exec.Cmd, feedStdin func(io.WriteCloser)) error {
+	if feedStdin == nil && c.stdin != nil {
+		cmd.Stdin = c.stdin
+	}
+
+	stdout, stderr, err := cmdPipes(cmd)
+	if err != nil {
+		return errors.Wrap(err, "failed to get stdout/stderr pipes")
+	}
+
+	var stdin io.WriteCloser
+	if feedStdin != nil {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return errors.Wrap(err, "failed to get stdin pipe")
+		}
+	}
+
+	if err = cmd.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start command '%v'", cmd.Path)
+	}
+
+	if feedStdin != nil {
+		go feedStdin(stdin)
+	}
+
+	waitDone := make(chan error, 1)
+	go func() {
+		c.handleOutput(stdout, stderr)
+		waitDone <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-waitDone:
+		c.exitCode = exitCode(cmd)
+		if err != nil {
+			return errors.Wrapf(err, "running command '%v' failed", cmd.Path)
+		}
+		return nil
+	case <-ctx.Done():
+		cancelCause := ctx.Err()
+		if cmd.Process != nil {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		}
+		select {
+		case <-waitDone:
+		case <-time.After(GracefulShutdownTimeout):
+			if cmd.Process != nil {
+				_ = cmd.Process.Kill()
+			}
+			<-waitDone
+		}
+		c.exitCode = exitCode(cmd)
+		return &ErrExecutionCancelled{Cause: cancelCause}
+	}
+}
+
+func exitCode(cmd *exec.Cmd) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	return cmd.ProcessState.ExitCode()
+}
+
+// handleOutput forwards stdout/stderr to the configured writers line by line, feeding each line
+// through parseConsoleErrors when error patterns or ErrorCategoryMapping are configured. It returns once both pipes
+// have been fully drained, which also happens when the underlying command is killed.
+func (c *Command) handleOutput(stdout, stderr io.Reader) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.scanAndForward(stdout, c.stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		c.scanAndForward(stderr, c.stderr)
+	}()
+	wg.Wait()
+}
+
+func (c *Command) scanAndForward(in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 4096), maxErrorCategoryLineLength)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(out, line)
+		if len(c.errorPatterns) > 0 || len(c.ErrorCategoryMapping) > 0 {
+			c.parseConsoleErrors(line)
+		}
+	}
+}
+
+// parseConsoleErrors checks line against the configured ErrorPatterns, falling back to the
+// legacy ErrorCategoryMapping when no ErrorPattern is configured, and records the resulting error
+// category (and, for ErrorPatterns, the extracted message) via the log package.
+func (c *Command) parseConsoleErrors(line string) {
+	if len(c.errorPatterns) > 0 {
+		c.parseErrorPatterns(line)
+		return
+	}
+
+	for category, patterns := range c.ErrorCategoryMapping {
+		for _, pattern := range patterns {
+			if matchPattern(line, pattern) {
+				log.SetErrorCategory(errorCategoryFromString(category))
+				return
+			}
+		}
+	}
+}
+
+// parseErrorPatterns finds the highest-priority ErrorPattern matching line, ties going to
+// whichever pattern was declared first, and records its category and extracted message.
+func (c *Command) parseErrorPatterns(line string) {
+	var best *ErrorPattern
+	var bestMatch []string
+
+	for i := range c.errorPatterns {
+		p := &c.errorPatterns[i]
+		match := p.Regexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if best == nil || p.Priority > best.Priority {
+			best = p
+			bestMatch = match
+		}
+	}
+
+	if best == nil {
+		return
+	}
+
+	log.SetErrorCategory(best.Category)
+
+	message := line
+	if best.CaptureGroup > 0 && best.CaptureGroup < len(bestMatch) {
+		message = bestMatch[best.CaptureGroup]
+	}
+	log.Entry().Error(message)
+}
+
+func errorCategoryFromString(category string) log.ErrorCategory {
+	switch strings.ToLower(category) {
+	case "build":
+		return log.ErrorBuild
+	case "config", "configuration":
+		return log.ErrorConfiguration
+	case "service":
+		return log.ErrorService
+	case "infrastructure":
+		return log.ErrorInfrastructure
+	case "compliance":
+		return log.ErrorCompliance
+	case "test":
+		return log.ErrorTest
+	case "custom":
+		return log.ErrorCustom
+	default:
+		return log.ErrorUndefined
+	}
+}
+
+// matchPattern reports whether text contains pattern, where each '*' in pattern is a wildcard
+// matching any text. An empty pattern only matches an empty text.
+func matchPattern(text, pattern string) bool {
+	if pattern == "" {
+		return text == ""
+	}
+
+	parts := strings.Split(pattern, "*")
+	pos := 0
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		idx := strings.Index(text[pos:], part)
+		if idx < 0 {
+			return false
+		}
+		pos += idx + len(part)
+	}
+	return true
+}
+
+// interpolateEnvVars expands $VAR/${VAR} references in params against env, which is expected to
+// hold "KEY=VALUE" entries as set via SetEnv.
+func interpolateEnvVars(params []string, env []string) []string {
+	if len(env) == 0 {
+		return params
+	}
+
+	lookup := func(key string) string {
+		for _, e := range env {
+			if kv := strings.SplitN(e, "=", 2); len(kv) == 2 && kv[0] == key {
+				return kv[1]
+			}
+		}
+		return ""
+	}
+
+	interpolated := make([]string, len(params))
+	for i, p := range params {
+		interpolated[i] = os.Expand(p, lookup)
+	}
+	return interpolated
+}
+
+// cmdPipes wires up stdout/stderr pipes for cmd so its output can be scanned before it is started.
+func cmdPipes(cmd *exec.Cmd) (io.Reader, io.Reader, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get stdout pipe")
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get stderr pipe")
+	}
+	return stdout, stderr, nil
+}
@@ -5,26 +5,92 @@ package command
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/SAP/jenkins-library/pkg/log"
 	"github.com/stretchr/testify/assert"
 )
 
+// helperProcessEnvVar, when set to "1" in a spawned process's environment, tells TestMain to
+// dispatch to the registered helper process instead of running the test suite.
+const helperProcessEnvVar = "GO_WANT_HELPER_PROCESS"
+
+var (
+	helperProcesses = map[string]func(args []string) int{}
+
+	usedHelperProcessesMu sync.Mutex
+	usedHelperProcesses   = map[string]bool{}
+)
+
+// registerHelperProcess makes name available as a fake external command for tests that replace
+// ExecCommand with helperCommand. Call it from a test file's init().
+func registerHelperProcess(name string, fn func(args []string) int) {
+	helperProcesses[name] = fn
+}
+
 // based on https://golang.org/src/os/exec/exec_test.go
 func helperCommand(command string, s ...string) (cmd *exec.Cmd) {
-	cs := []string{"-test.run=TestHelperProcess", "--", command}
-	cs = append(cs, s...)
-	cmd = exec.Command(os.Args[0], cs...)
-	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+	usedHelperProcessesMu.Lock()
+	usedHelperProcesses[command] = true
+	usedHelperProcessesMu.Unlock()
+
+	cmd = exec.Command(os.Args[0], append([]string{command}, s...)...)
+	cmd.Env = []string{helperProcessEnvVar + "=1"}
 	return cmd
 }
 
+// TestMain either re-dispatches this binary as one of the helper processes registered via
+// registerHelperProcess (when invoked through helperCommand) or runs the test suite as usual,
+// additionally failing the suite if a registered helper process was never exercised by any test.
+func TestMain(m *testing.M) {
+	if os.Getenv(helperProcessEnvVar) == "1" {
+		os.Exit(runHelperProcess(os.Args[1:]))
+	}
+
+	code := m.Run()
+
+	var unused []string
+	for name := range helperProcesses {
+		if !usedHelperProcesses[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		fmt.Fprintf(os.Stderr, "helper process(es) registered but never invoked: %v\n", unused)
+		code = 1
+	}
+
+	os.Exit(code)
+}
+
+func runHelperProcess(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "no command")
+		return 2
+	}
+
+	name, args := args[0], args[1:]
+	fn, ok := helperProcesses[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown helper process %q\n", name)
+		return 2
+	}
+	return fn(args)
+}
+
 func TestShellRun(t *testing.T) {
 
 	t.Run("test shell", func(t *testing.T) {
@@ -99,6 +165,63 @@ func TestExecutableRun(t *testing.T) {
 	})
 }
 
+func TestExecutableRunWithStdin(t *testing.T) {
+
+	t.Run("test executable with injected stdin", func(t *testing.T) {
+		ExecCommand = helperCommand
+		defer func() { ExecCommand = exec.Command }()
+		o := new(bytes.Buffer)
+		e := new(bytes.Buffer)
+
+		s := Command{stdout: o, stderr: e}
+		s.SetStdin(strings.NewReader("myScript"))
+		s.RunExecutable("/bin/bash")
+
+		t.Run("stdin-stdout", func(t *testing.T) {
+			expectedOut := "Stdout: command /bin/bash - Stdin: myScript\n"
+			if oStr := o.String(); oStr != expectedOut {
+				t.Errorf("expected: %v got: %v", expectedOut, oStr)
+			}
+		})
+		t.Run("stderr", func(t *testing.T) {
+			expectedErr := "Stderr: command /bin/bash\n"
+			if eStr := e.String(); eStr != expectedErr {
+				t.Errorf("expected: %v got: %v", expectedErr, eStr)
+			}
+		})
+	})
+}
+
+func TestRunExecutableContext(t *testing.T) {
+
+	t.Run("deadline exceeded terminates the process", func(t *testing.T) {
+		ExecCommand = helperCommand
+		defer func() { ExecCommand = exec.Command }()
+
+		stdout := new(bytes.Buffer)
+		stderr := new(bytes.Buffer)
+		c := Command{stdout: stdout, stderr: stderr}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := c.RunExecutableContext(ctx, "sleep", "5s")
+		elapsed := time.Since(start)
+
+		var cancelled *ErrExecutionCancelled
+		if !errors.As(err, &cancelled) {
+			t.Fatalf("expected *ErrExecutionCancelled, got: %v", err)
+		}
+		if !errors.Is(cancelled.Cause, context.DeadlineExceeded) {
+			t.Errorf("expected cause to be context.DeadlineExceeded, got: %v", cancelled.Cause)
+		}
+		if elapsed > GracefulShutdownTimeout {
+			t.Errorf("expected command to be terminated well before the grace period elapsed, took: %v", elapsed)
+		}
+	})
+}
+
 func TestEnvironmentVariables(t *testing.T) {
 
 	ExecCommand = helperCommand
@@ -123,6 +246,119 @@ func TestEnvironmentVariables(t *testing.T) {
 	}
 }
 
+func TestWorkingDirectory(t *testing.T) {
+	ExecCommand = helperCommand
+	defer func() { ExecCommand = exec.Command }()
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+
+	dir, err := ioutil.TempDir("", "command-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// resolve symlinks (e.g. /tmp -> /private/tmp on macOS) so the comparison below is stable
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("failed to resolve temp dir: %v", err)
+	}
+
+	ex := Command{stdout: stdout, stderr: stderr}
+	ex.SetDir(dir)
+	if err := ex.RunExecutable("pwd"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := strings.TrimSpace(stdout.String()); got != dir {
+		t.Errorf("expected child process to observe cwd %v, got: %v", dir, got)
+	}
+
+	t.Run("rejects a non-existing directory", func(t *testing.T) {
+		ex := Command{stdout: stdout, stderr: stderr}
+		ex.SetDir(filepath.Join(dir, "does-not-exist"))
+		if err := ex.RunExecutable("pwd"); err == nil {
+			t.Errorf("expected an error for a non-existing working directory")
+		}
+	})
+}
+
+func TestAppendEnv(t *testing.T) {
+	ExecCommand = helperCommand
+	defer func() { ExecCommand = exec.Command }()
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+
+	ex := Command{stdout: stdout, stderr: stderr}
+
+	// helperCommand presets cmd.Env to a single GO_WANT_HELPER_PROCESS entry; AppendEnv must
+	// merge on top of that rather than replace it, or the helper process wouldn't recognize
+	// itself and the test would hang waiting for output that never comes.
+	ex.AppendEnv([]string{"DEBUG=true"})
+	ex.RunExecutable("env")
+
+	oStr := stdout.String()
+	if !strings.Contains(oStr, "GO_WANT_HELPER_PROCESS=1") {
+		t.Errorf("expected base environment to be preserved")
+	}
+	if !strings.Contains(oStr, "DEBUG=true") {
+		t.Errorf("expected appended environment variable not found")
+	}
+}
+
+func TestMergeEnvForOS(t *testing.T) {
+	tt := []struct {
+		name     string
+		base     []string
+		env      []string
+		goos     string
+		expected []string
+	}{
+		{
+			name:     "no duplicates",
+			base:     []string{"PATH=/usr/bin"},
+			env:      []string{"DEBUG=true"},
+			goos:     "linux",
+			expected: []string{"PATH=/usr/bin", "DEBUG=true"},
+		},
+		{
+			name:     "duplicate key keeps position, takes last value",
+			base:     []string{"PATH=/usr/bin", "DEBUG=false"},
+			env:      []string{"DEBUG=true"},
+			goos:     "linux",
+			expected: []string{"PATH=/usr/bin", "DEBUG=true"},
+		},
+		{
+			name:     "mixed case keys are distinct outside Windows",
+			base:     []string{"Path=/usr/bin"},
+			env:      []string{"PATH=/usr/local/bin"},
+			goos:     "linux",
+			expected: []string{"Path=/usr/bin", "PATH=/usr/local/bin"},
+		},
+		{
+			name:     "mixed case keys are folded on Windows",
+			base:     []string{"Path=C:\\old"},
+			env:      []string{"PATH=C:\\new"},
+			goos:     "windows",
+			expected: []string{"PATH=C:\\new"},
+		},
+		{
+			name:     "leading-= entries are preserved, not dropped",
+			base:     []string{"=C:=C:\\old", "=C:=C:\\other"},
+			env:      []string{"DEBUG=true"},
+			goos:     "windows",
+			expected: []string{"=C:=C:\\old", "=C:=C:\\other", "DEBUG=true"},
+		},
+	}
+
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, mergeEnvForOS(test.base, test.env, test.goos))
+		})
+	}
+}
+
 func TestEnvironmentVariablesInterpolation(t *testing.T) {
 	defer func() { ExecCommand = exec.Command }()
 
@@ -218,6 +454,70 @@ func TestParseConsoleErrors(t *testing.T) {
 	log.SetErrorCategory(log.ErrorUndefined)
 }
 
+func TestParseErrorPatterns(t *testing.T) {
+	cmd := Command{
+		errorPatterns: []ErrorPattern{
+			{Regexp: regexp.MustCompile(`\[ERROR\]`), Category: log.ErrorBuild, Priority: 1},
+			{Regexp: regexp.MustCompile(`npm ERR! (.*)`), Category: log.ErrorBuild, Priority: 1, CaptureGroup: 1},
+			{Regexp: regexp.MustCompile(`FATAL: (.*)`), Category: log.ErrorConfiguration, Priority: 10, CaptureGroup: 1},
+		},
+	}
+
+	tt := []struct {
+		name             string
+		consoleLine      string
+		expectedCategory log.ErrorCategory
+	}{
+		{name: "no match", consoleLine: "all good", expectedCategory: log.ErrorUndefined},
+		{name: "single match", consoleLine: "[ERROR] build failed", expectedCategory: log.ErrorBuild},
+		{name: "higher priority wins", consoleLine: "[ERROR] FATAL: bad config", expectedCategory: log.ErrorConfiguration},
+	}
+
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			log.SetErrorCategory(log.ErrorUndefined)
+			cmd.parseConsoleErrors(test.consoleLine)
+			assert.Equal(t, test.expectedCategory, log.GetErrorCategory())
+		})
+	}
+	log.SetErrorCategory(log.ErrorUndefined)
+}
+
+func TestLoadErrorPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "error-patterns")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "patterns.yaml")
+	yamlContent := `
+- pattern: '^\[ERROR\]'
+  category: build
+  priority: 10
+- pattern: 'npm ERR! (.*)'
+  category: build
+  priority: 5
+  captureGroup: 1
+`
+	if err := ioutil.WriteFile(path, []byte(yamlContent), 0600); err != nil {
+		t.Fatalf("failed to write pattern file: %v", err)
+	}
+
+	patterns, err := LoadErrorPatterns(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(patterns) != 2 {
+		t.Fatalf("expected 2 patterns, got %v", len(patterns))
+	}
+	assert.Equal(t, log.ErrorBuild, patterns[0].Category)
+	assert.Equal(t, 10, patterns[0].Priority)
+	assert.True(t, patterns[0].Regexp.MatchString("[ERROR] failed"))
+	assert.Equal(t, 1, patterns[1].CaptureGroup)
+}
+
 func TestMatchPattern(t *testing.T) {
 	tt := []struct {
 		text     string
@@ -267,53 +567,62 @@ func TestCmdPipes(t *testing.T) {
 }
 
 // based on https://golang.org/src/os/exec/exec_test.go
-// this is not directly executed
-func TestHelperProcess(*testing.T) {
+func init() {
+	registerHelperProcess("/bin/bash", helperBash)
+	registerHelperProcess("echo", helperEcho)
+	registerHelperProcess("env", helperEnv)
+	registerHelperProcess("long", helperLong)
+	registerHelperProcess("pwd", helperPwd)
+	registerHelperProcess("sleep", helperSleep)
+}
 
-	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
-		return
-	}
-	defer os.Exit(0)
+func helperBash([]string) int {
+	o, _ := ioutil.ReadAll(os.Stdin)
+	fmt.Fprintf(os.Stdout, "Stdout: command /bin/bash - Stdin: %v\n", string(o))
+	fmt.Fprintln(os.Stderr, "Stderr: command /bin/bash")
+	return 0
+}
 
-	args := os.Args
-	for len(args) > 0 {
-		if args[0] == "--" {
-			args = args[1:]
-			break
-		}
-		args = args[1:]
+func helperEcho(args []string) int {
+	iargs := make([]interface{}, len(args))
+	for i, s := range args {
+		iargs[i] = s
 	}
-	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "No command\n")
-		os.Exit(2)
+	fmt.Println(iargs...)
+	fmt.Fprintln(os.Stderr, "Stderr: command echo")
+	return 0
+}
+
+func helperEnv([]string) int {
+	for _, e := range os.Environ() {
+		fmt.Println(e)
 	}
+	return 0
+}
 
-	cmd, args := args[0], args[1:]
-	switch cmd {
-	case "/bin/bash":
-		o, _ := ioutil.ReadAll(os.Stdin)
-		fmt.Fprintf(os.Stdout, "Stdout: command %v - Stdin: %v\n", cmd, string(o))
-		fmt.Fprintf(os.Stderr, "Stderr: command %v\n", cmd)
-	case "echo":
-		iargs := []interface{}{}
-		for _, s := range args {
-			iargs = append(iargs, s)
-		}
-		fmt.Println(iargs...)
-		fmt.Fprintf(os.Stderr, "Stderr: command %v\n", cmd)
-	case "env":
-		for _, e := range os.Environ() {
-			fmt.Println(e)
-		}
-	case "long":
-		b := []byte("a")
-		size := 64000
-		b = bytes.Repeat(b, size)
+func helperLong([]string) int {
+	b := bytes.Repeat([]byte("a"), 64000)
+	fmt.Fprint(os.Stderr, string(b))
+	return 0
+}
 
-		fmt.Fprint(os.Stderr, b)
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown command %q\n", cmd)
-		os.Exit(2)
+func helperPwd([]string) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get working directory: %v\n", err)
+		return 2
+	}
+	fmt.Fprintln(os.Stdout, wd)
+	return 0
+}
 
+func helperSleep(args []string) int {
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid duration %q\n", args[0])
+		return 2
 	}
+	time.Sleep(d)
+	fmt.Fprintln(os.Stdout, "done")
+	return 0
 }